@@ -1,17 +1,38 @@
 package main
 
 import (
+	"encoding/gob"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
+// underflowEpsilon is how close the top two class scores must be, in
+// log-space, before LogScores reports the result as not strict and
+// SafeClassify returns ErrUnderflow.
+const underflowEpsilon = 1e-9
+
+// ErrUnderflow is returned by SafeClassify when two or more classes tie for
+// the highest score within underflowEpsilon, meaning the classification
+// cannot be trusted to single out one class.
+var ErrUnderflow = errors.New("naivebayes: classification underflowed, top classes are indistinguishable")
+
 // Class contains the document count, an array of all words used in those documents
-// (the array contains duplicates) and a map with the word frequency which can
-// be used to obtain the unique word count.
+// (the array contains duplicates), a map with the word frequency, and (in TF-IDF
+// mode) FreqTfs holding each term's per-document frequency, used by
+// ConvertTermsFreqToTFIDF to derive how many documents contain the term.
 type Class struct {
 	Documents float64
 	Words     []string
 	WordFreq  map[string]float64
+	FreqTfs   map[string][]float64
 }
 
 // Classifier gives us total document count, the length of the NSplit being used,
@@ -22,6 +43,72 @@ type Classifier struct {
 	Documents   float64
 	Classes     map[string]*Class
 	UniqueWords map[string]float64
+
+	tfidf      bool
+	didConvert bool
+	tokenizer  Tokenizer
+
+	// Thresholds holds, per class, the minimum FisherClassify probability a
+	// caller requires before accepting that class as a match.
+	Thresholds map[string]float64
+	// Minimums holds, per class, the minimum training document count
+	// FisherClassify requires before scoring that class at all.
+	Minimums map[string]float64
+
+	mu   sync.RWMutex
+	seen uint64
+}
+
+// TextDatapoint is a single training example, as consumed by TrainStream.
+type TextDatapoint struct {
+	Class    string
+	Sentence string
+}
+
+// Option configures a Classifier at construction time. See WithTFIDF and
+// WithTokenizer.
+type Option func(*Classifier)
+
+// WithTFIDF switches the Classifier into TF-IDF mode: Train records a
+// per-document term-frequency vector alongside the usual flat word counts,
+// and ConvertTermsFreqToTFIDF must be called once training is done.
+func WithTFIDF() Option {
+	return func(c *Classifier) {
+		c.tfidf = true
+	}
+}
+
+// WithTokenizer overrides the Classifier's default tokenizer, which is
+// NGramTokenizer(n, SpaceTokenizer).
+func WithTokenizer(t Tokenizer) Option {
+	return func(c *Classifier) {
+		c.tokenizer = t
+	}
+}
+
+// Tokenizer turns a sentence into the tokens Train and Classify operate on.
+type Tokenizer func(string) []string
+
+// SpaceTokenizer is the default Tokenizer: it lowercases the sentence and
+// splits it on runs of Unicode whitespace.
+func SpaceTokenizer(sentence string) []string {
+	return strings.Fields(strings.ToLower(sentence))
+}
+
+// NGramTokenizer composes over any base Tokenizer, joining every run of n
+// consecutive tokens base produces into a single token.
+func NGramTokenizer(n int, base Tokenizer) Tokenizer {
+	return func(sentence string) []string {
+		return joinNGrams(n, base(sentence))
+	}
+}
+
+// SanitizerTokenizer composes over any base Tokenizer, stripping everything
+// re matches from the sentence before handing it to base.
+func SanitizerTokenizer(re *regexp.Regexp, base Tokenizer) Tokenizer {
+	return func(sentence string) []string {
+		return base(re.ReplaceAllString(sentence, ""))
+	}
 }
 
 // SplitWords returns an array of sequences of n items. The length n is defined
@@ -31,88 +118,469 @@ type Classifier struct {
 //
 // The input (2, "this outputs NSplit") would be ["this outputs", "outputs NSplit"].
 func SplitWords(size int, sentence string) []string {
-	sliptedWords := []string{}
-	words := strings.Split(sentence, " ")
+	return joinNGrams(size, strings.Split(sentence, " "))
+}
+
+// joinNGrams groups words into every run of size consecutive items, joined
+// back into a single string. It backs both SplitWords and NGramTokenizer.
+func joinNGrams(size int, words []string) []string {
+	grams := []string{}
 
 	if len(words) <= size {
-		sliptedWords = append(sliptedWords, strings.Join(words, " "))
-		return sliptedWords
+		grams = append(grams, strings.Join(words, " "))
+		return grams
 	}
 
 	for i := 0; i+size <= len(words); i++ {
-		sliptedWords = append(sliptedWords, strings.Join(words[i:i+size], " "))
+		grams = append(grams, strings.Join(words[i:i+size], " "))
 	}
 
-	return sliptedWords
+	return grams
 }
 
 // NewClassifier returns a new classifier which initiates two empty maps. This
 // could later be improved so that everything is saved more efficiently.
-func NewClassifier(n int) *Classifier {
-	return &Classifier{
+func NewClassifier(n int, opts ...Option) *Classifier {
+	c := &Classifier{
 		NSplit:      n,
 		Classes:     make(map[string]*Class),
 		UniqueWords: make(map[string]float64),
+		Thresholds:  make(map[string]float64),
+		Minimums:    make(map[string]float64),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.tokenizer == nil {
+		c.tokenizer = NGramTokenizer(n, SpaceTokenizer)
 	}
+
+	return c
 }
 
-// Train adds the splitted words of a sentence to an existing or new class.
+// Train adds the splitted words of a sentence to an existing or new class,
+// recording a TF-IDF per-document frequency vector too when WithTFIDF is
+// set. It takes the Classifier's write lock, so it is safe to call
+// concurrently with itself, Classify and GetPrior.
 func (c *Classifier) Train(class string, sentence string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.Documents++
 	_, exists := c.Classes[class]
 	if exists == false {
 		c.Classes[class] = &Class{
 			WordFreq: make(map[string]float64),
+			FreqTfs:  make(map[string][]float64),
 		}
 	}
 
 	c.Classes[class].Documents++
-	words := SplitWords(c.NSplit, sentence)
+	words := c.tokenizer(sentence)
 	for _, word := range words {
 		c.UniqueWords[word]++
 		c.Classes[class].Words = append(c.Classes[class].Words, word)
 		c.Classes[class].WordFreq[word]++
 	}
+
+	if c.tfidf {
+		docFreq := make(map[string]float64)
+		for _, word := range words {
+			docFreq[word]++
+		}
+		for word, freq := range docFreq {
+			tf := freq / float64(len(words))
+			c.Classes[class].FreqTfs[word] = append(c.Classes[class].FreqTfs[word], tf)
+		}
+	}
+
+	atomic.AddUint64(&c.seen, 1)
+}
+
+// TrainStream trains the Classifier on every TextDatapoint from ch across a
+// pool of worker goroutines, and blocks until ch is closed and all of them
+// have finished.
+func (c *Classifier) TrainStream(ch <-chan TextDatapoint) error {
+	workers := runtime.NumCPU()
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for dp := range ch {
+				c.Train(dp.Class, dp.Sentence)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// Seen returns the number of documents Train has processed so far.
+func (c *Classifier) Seen() uint64 {
+	return atomic.LoadUint64(&c.seen)
+}
+
+// ConvertTermsFreqToTFIDF reweights every class's WordFreq from a plain term
+// count into a TF-IDF score, multiplying each term's frequency by
+// log(TotalDocuments / DocumentsContainingTerm). Call it once after training
+// a WithTFIDF Classifier and before classifying; Classify panics if it was
+// not called, and this panics if called twice.
+func (c *Classifier) ConvertTermsFreqToTFIDF() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.didConvert {
+		panic("naivebayes: ConvertTermsFreqToTFIDF already called on this classifier")
+	}
+
+	documentsContainingTerm := make(map[string]float64)
+	for _, data := range c.Classes {
+		for word, tfs := range data.FreqTfs {
+			documentsContainingTerm[word] += float64(len(tfs))
+		}
+	}
+
+	for _, data := range c.Classes {
+		for word := range data.WordFreq {
+			count := documentsContainingTerm[word]
+			if count == 0 {
+				continue
+			}
+			data.WordFreq[word] *= math.Log(c.Documents / count)
+		}
+	}
+
+	c.didConvert = true
 }
 
 // GetPrior returns the prior probabilities of a document being in a specific
 // class. It is calculated by dividing the class frequency by the total amount
-// of documents.
+// of documents, and takes the Classifier's read lock, so it is safe to call
+// concurrently with Train.
 func (c *Classifier) GetPrior(class string) float64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.getPriorLocked(class)
+}
+
+// getPriorLocked is GetPrior's implementation without locking, for callers
+// that already hold c.mu.
+func (c *Classifier) getPriorLocked(class string) float64 {
 	return c.Classes[class].Documents / c.Documents
 }
 
-// Classify returns the probabilities for a sentence belonging to a
-// certain class. These probabilities are calculated by taking the class prior
-// P(class) and multiplying it by the conditional probabilities P(word|class).
-func (c *Classifier) Classify(sentence string) map[string]float64 {
+// LogScores returns, for every class, the log-space score
+// log(P(class)) + sum(log(P(word|class))), which stays finite on inputs
+// long enough to underflow a direct product of probabilities, plus the
+// highest-scoring class (likely) and whether that result is strict, i.e.
+// not tied with another class within underflowEpsilon. It takes the
+// Classifier's read lock, so it is safe to call concurrently with itself,
+// GetPrior and Train.
+func (c *Classifier) LogScores(sentence string) (scores map[string]float64, likely string, strict bool) {
+	if c.tfidf && !c.didConvert {
+		panic("naivebayes: ConvertTermsFreqToTFIDF must be called before classifying a TF-IDF model")
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
 	uniqueWordCount := float64(len(c.UniqueWords))
-	words := SplitWords(c.NSplit, sentence)
-	cProbabilities := make(map[string]float64)
+	words := c.tokenizer(sentence)
+	scores = make(map[string]float64)
 
 	for class, data := range c.Classes {
-		prior := c.GetPrior(class)
+		prior := c.getPriorLocked(class)
 		classWordCount := float64(len(data.Words))
-		wProbabilities := make(map[string]float64)
+		score := math.Log(prior)
 		for _, word := range words {
 			frequency, exists := data.WordFreq[word]
 			if exists == false {
 				frequency = 0
 			}
 
-			wProbabilities[word] = (frequency + 1.0) / (classWordCount + uniqueWordCount)
+			score += math.Log((frequency + 1.0) / (classWordCount + uniqueWordCount))
 		}
-		result := prior
-		for _, value := range wProbabilities {
-			result = result * (value)
+		scores[class] = score
+	}
+
+	best := math.Inf(-1)
+	runnerUp := math.Inf(-1)
+	for class, score := range scores {
+		if score > best {
+			runnerUp = best
+			best = score
+			likely = class
+		} else if score > runnerUp {
+			runnerUp = score
 		}
-		cProbabilities[class] = result
+	}
 
+	strict = best-runnerUp > underflowEpsilon
+	return scores, likely, strict
+}
+
+// Classify returns, for each class, the class prior P(class) multiplied by
+// the conditional probabilities P(word|class) of the sentence, scaled so the
+// highest-scoring class is 1.0 and the others are relative to it.
+//
+// It delegates to LogScores and exponentiates relative to the highest log
+// score, so the top class always exponentiates to 1.0 instead of every
+// class underflowing to 0 on long or varied inputs.
+func (c *Classifier) Classify(sentence string) map[string]float64 {
+	logScores, _, _ := c.LogScores(sentence)
+
+	maxScore := math.Inf(-1)
+	for _, score := range logScores {
+		if score > maxScore {
+			maxScore = score
+		}
+	}
+
+	cProbabilities := make(map[string]float64, len(logScores))
+	for class, score := range logScores {
+		cProbabilities[class] = math.Exp(score - maxScore)
 	}
 
 	return cProbabilities
 }
 
+// SafeClassify behaves like Classify but reports ErrUnderflow when the top
+// two classes are indistinguishable, instead of silently picking a winner.
+func (c *Classifier) SafeClassify(sentence string) (class string, err error) {
+	_, likely, strict := c.LogScores(sentence)
+	if !strict {
+		return likely, ErrUnderflow
+	}
+
+	return likely, nil
+}
+
+// SetThreshold sets the minimum Fisher probability a caller requires of
+// class before treating a FisherClassify result as a match.
+func (c *Classifier) SetThreshold(class string, t float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.Thresholds[class] = t
+}
+
+// SetMinimum sets the minimum number of training documents class must have
+// before FisherClassify will score it.
+func (c *Classifier) SetMinimum(class string, m float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.Minimums[class] = m
+}
+
+// FisherClassify scores a sentence against every class using Fisher's
+// method, which tends to behave better than Classify on short inputs. For
+// each word it computes P(class|word) = P(word|class) / sum_over_classes
+// P(word|c), combines those per class via chi = -2 * sum(log(p_i)), and
+// converts chi back into a probability with invchi2. Classes below their
+// SetMinimum are left out; compare the result against SetThreshold to
+// decide whether a class counts as a match.
+func (c *Classifier) FisherClassify(sentence string) map[string]float64 {
+	if c.tfidf && !c.didConvert {
+		panic("naivebayes: ConvertTermsFreqToTFIDF must be called before classifying a TF-IDF model")
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	uniqueWordCount := float64(len(c.UniqueWords))
+	words := c.tokenizer(sentence)
+
+	seenWord := make(map[string]bool, len(words))
+	uniqueSentenceWords := make([]string, 0, len(words))
+	for _, word := range words {
+		if !seenWord[word] {
+			seenWord[word] = true
+			uniqueSentenceWords = append(uniqueSentenceWords, word)
+		}
+	}
+
+	classNames := make([]string, 0, len(c.Classes))
+	for class, data := range c.Classes {
+		if data.Documents < c.Minimums[class] {
+			continue
+		}
+		classNames = append(classNames, class)
+	}
+
+	logSums := make(map[string]float64, len(classNames))
+	for _, word := range uniqueSentenceWords {
+		wordProbs := make(map[string]float64, len(classNames))
+		total := 0.0
+		for _, class := range classNames {
+			data := c.Classes[class]
+			classWordCount := float64(len(data.Words))
+			frequency := data.WordFreq[word]
+			p := (frequency + 1.0) / (classWordCount + uniqueWordCount)
+			wordProbs[class] = p
+			total += p
+		}
+
+		for _, class := range classNames {
+			pClassGivenWord := wordProbs[class] / total
+			logSums[class] += math.Log(pClassGivenWord)
+		}
+	}
+
+	df := 2 * len(uniqueSentenceWords)
+	scores := make(map[string]float64, len(classNames))
+	for _, class := range classNames {
+		scores[class] = invchi2(-2*logSums[class], df)
+	}
+
+	return scores
+}
+
+// invchi2 approximates the chi-squared survival function P(X > chi) for df
+// degrees of freedom as an iterative series sum, accurate enough for the
+// small, even df values FisherClassify produces (df = 2k for k distinct
+// words).
+func invchi2(chi float64, df int) float64 {
+	if chi <= 0 {
+		return 1.0
+	}
+
+	m := chi / 2
+	term := math.Exp(-m)
+	sum := term
+	for i := 1; i < df/2; i++ {
+		term *= m / float64(i)
+		sum += term
+	}
+
+	return math.Min(sum, 1.0)
+}
+
+// classifierFormatVersion is written as the first byte of every stream
+// produced by WriteTo, so LoadClassifier can reject a stream written by an
+// incompatible future format instead of failing on a confusing gob error.
+const classifierFormatVersion byte = 1
+
+// serializableClassifier mirrors Classifier's trained state, including the
+// unexported TF-IDF flags, in exported, gob-encodable fields. It cannot capture Tokenizer, since funcs aren't gob-encodable; see
+// LoadClassifier.
+type serializableClassifier struct {
+	NSplit      int
+	Documents   float64
+	Classes     map[string]*Class
+	UniqueWords map[string]float64
+	TFIDF       bool
+	DidConvert  bool
+	Thresholds  map[string]float64
+	Minimums    map[string]float64
+}
+
+// countingWriter wraps an io.Writer to report how many bytes were written
+// through it, since gob.Encoder does not expose that itself.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	written, err := cw.w.Write(p)
+	cw.n += int64(written)
+	return written, err
+}
+
+// WriteTo gob-encodes the classifier's trained state to w, preceded by a
+// single format-version byte, and returns the number of bytes written. It
+// does not encode the Classifier's Tokenizer; see LoadClassifier.
+func (c *Classifier) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	if _, err := cw.Write([]byte{classifierFormatVersion}); err != nil {
+		return cw.n, err
+	}
+
+	sc := serializableClassifier{
+		NSplit:      c.NSplit,
+		Documents:   c.Documents,
+		Classes:     c.Classes,
+		UniqueWords: c.UniqueWords,
+		TFIDF:       c.tfidf,
+		DidConvert:  c.didConvert,
+		Thresholds:  c.Thresholds,
+		Minimums:    c.Minimums,
+	}
+	if err := gob.NewEncoder(cw).Encode(sc); err != nil {
+		return cw.n, err
+	}
+
+	return cw.n, nil
+}
+
+// SaveToFile writes the classifier's trained state to the file at path,
+// creating or truncating it as needed.
+func (c *Classifier) SaveToFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = c.WriteTo(f)
+	return err
+}
+
+// LoadClassifier reads a classifier previously written by WriteTo or
+// SaveToFile, applying opts as NewClassifier does. Pass the same
+// WithTokenizer the classifier was trained with, or Classify will use the
+// default tokenizer instead and produce degraded results.
+func LoadClassifier(r io.Reader, opts ...Option) (*Classifier, error) {
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(r, version); err != nil {
+		return nil, fmt.Errorf("naivebayes: reading classifier format version: %w", err)
+	}
+	if version[0] != classifierFormatVersion {
+		return nil, fmt.Errorf("naivebayes: unsupported classifier format version %d", version[0])
+	}
+
+	var sc serializableClassifier
+	if err := gob.NewDecoder(r).Decode(&sc); err != nil {
+		return nil, err
+	}
+
+	c := NewClassifier(sc.NSplit, opts...)
+	c.Documents = sc.Documents
+	c.Classes = sc.Classes
+	c.UniqueWords = sc.UniqueWords
+	c.tfidf = sc.TFIDF
+	c.didConvert = sc.DidConvert
+	if sc.Thresholds != nil {
+		c.Thresholds = sc.Thresholds
+	}
+	if sc.Minimums != nil {
+		c.Minimums = sc.Minimums
+	}
+	return c, nil
+}
+
+// NewClassifierFromFile opens path and loads a classifier previously saved
+// with SaveToFile. See LoadClassifier for the Tokenizer caveat around opts.
+func NewClassifierFromFile(path string, opts ...Option) (*Classifier, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return LoadClassifier(f, opts...)
+}
+
 func main() {
 	classifier := NewClassifier(1)
 
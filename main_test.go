@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestLogScoresAvoidsUnderflowOnLongInput(t *testing.T) {
+	c := NewClassifier(1)
+	c.Train("bom", "eu te adoro")
+	c.Train("bom", "eu te amo")
+	c.Train("ruim", "eu te odeio")
+	c.Train("ruim", "eu quero ver queimar")
+
+	words := make([]string, 400)
+	for i := range words {
+		words[i] = "eu"
+	}
+	sentence := strings.Join(words, " ")
+
+	scores, likely, _ := c.LogScores(sentence)
+	for class, score := range scores {
+		if math.IsInf(score, 0) || math.IsNaN(score) {
+			t.Fatalf("LogScores[%s] = %v, want a finite score", class, score)
+		}
+	}
+	if likely != "bom" && likely != "ruim" {
+		t.Fatalf("LogScores likely = %q, want bom or ruim", likely)
+	}
+
+	if _, err := c.SafeClassify(sentence); err != nil && err != ErrUnderflow {
+		t.Fatalf("SafeClassify returned unexpected error: %v", err)
+	}
+}
+
+func TestClassifyAvoidsUnderflowOnLongInput(t *testing.T) {
+	c := NewClassifier(1)
+	c.Train("bom", "eu te adoro")
+	c.Train("bom", "eu te amo")
+	c.Train("ruim", "eu te odeio")
+	c.Train("ruim", "eu quero ver queimar")
+
+	words := make([]string, 2000)
+	for i := range words {
+		words[i] = "eu"
+	}
+	sentence := strings.Join(words, " ")
+
+	probabilities := c.Classify(sentence)
+	if probabilities["bom"] == 0 && probabilities["ruim"] == 0 {
+		t.Fatalf("Classify degenerated to all zeros: %v", probabilities)
+	}
+	if probabilities["bom"] == probabilities["ruim"] {
+		t.Fatalf("Classify produced indistinguishable probabilities: %v", probabilities)
+	}
+}
+
+func TestInvchi2KnownValues(t *testing.T) {
+	cases := []struct {
+		chi  float64
+		df   int
+		want float64
+	}{
+		{chi: 0, df: 2, want: 1.0},
+		{chi: 2 * math.Ln2, df: 2, want: 0.5},
+		{chi: 2, df: 4, want: 2 * math.Exp(-1)},
+	}
+	for _, tc := range cases {
+		if got := invchi2(tc.chi, tc.df); math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("invchi2(%v, %d) = %v, want %v", tc.chi, tc.df, got, tc.want)
+		}
+	}
+}
+
+func TestFisherClassifyMatchesHandComputedProbabilities(t *testing.T) {
+	c := NewClassifier(1)
+	c.Train("bom", "adoro")
+	c.Train("ruim", "odeio")
+
+	scores := c.FisherClassify("adoro")
+
+	// Both classes have classWordCount = 1 (one training word each) and
+	// uniqueWordCount = 2 (adoro, odeio); P(word|class) uses Laplace
+	// smoothing (freq+1)/(classWordCount+uniqueWordCount), then Fisher's
+	// method normalizes across classes. With one word and df = 2, invchi2
+	// reduces to exp(-chi/2), which is exactly the normalized probability.
+	pBom := (1.0 + 1.0) / (1.0 + 2.0)
+	pRuim := (0.0 + 1.0) / (1.0 + 2.0)
+	total := pBom + pRuim
+	wantBomProb := pBom / total
+	wantRuimProb := pRuim / total
+
+	if math.Abs(scores["bom"]-wantBomProb) > 1e-9 {
+		t.Errorf("FisherClassify[bom] = %v, want %v", scores["bom"], wantBomProb)
+	}
+	if math.Abs(scores["ruim"]-wantRuimProb) > 1e-9 {
+		t.Errorf("FisherClassify[ruim] = %v, want %v", scores["ruim"], wantRuimProb)
+	}
+}
+
+func TestTrainStreamIsConcurrencySafe(t *testing.T) {
+	c := NewClassifier(1)
+
+	samples := []TextDatapoint{
+		{Class: "bom", Sentence: "eu te adoro"},
+		{Class: "bom", Sentence: "eu te amo"},
+		{Class: "ruim", Sentence: "eu te odeio"},
+		{Class: "ruim", Sentence: "eu quero ver queimar"},
+	}
+
+	ch := make(chan TextDatapoint)
+	go func() {
+		defer close(ch)
+		for i := 0; i < 100; i++ {
+			ch <- samples[i%len(samples)]
+		}
+	}()
+
+	if err := c.TrainStream(ch); err != nil {
+		t.Fatalf("TrainStream: %v", err)
+	}
+
+	if got, want := c.Seen(), uint64(100); got != want {
+		t.Fatalf("Seen() = %d, want %d", got, want)
+	}
+	if _, _, strict := c.LogScores("eu te adoro"); !strict {
+		t.Fatalf("LogScores not strict after concurrent training")
+	}
+}
+
+func TestSanitizerTokenizerComposesWithNGramTokenizer(t *testing.T) {
+	punctuation := regexp.MustCompile(`[^\w\s]`)
+	tokenizer := NGramTokenizer(2, SanitizerTokenizer(punctuation, SpaceTokenizer))
+
+	got := tokenizer("Eu te adoro, muito!")
+	want := []string{"eu te", "te adoro", "adoro muito"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("tokenizer(%q) = %v, want %v", "Eu te adoro, muito!", got, want)
+	}
+}
+
+func TestConvertTermsFreqToTFIDFReweightsProbabilities(t *testing.T) {
+	train := func(c *Classifier) {
+		c.Train("bom", "eu te adoro muito")
+		c.Train("bom", "eu te amo")
+		c.Train("ruim", "eu te odeio")
+		c.Train("ruim", "eu quero ver queimar")
+	}
+
+	plain := NewClassifier(1)
+	train(plain)
+	before := plain.Classify("eu te adoro")
+
+	tfidf := NewClassifier(1, WithTFIDF())
+	train(tfidf)
+	tfidf.ConvertTermsFreqToTFIDF()
+	after := tfidf.Classify("eu te adoro")
+
+	if before["ruim"] == after["ruim"] {
+		t.Fatalf("TF-IDF reweighting left probabilities unchanged: plain %v, tfidf %v", before, after)
+	}
+	for class, p := range after {
+		if math.IsNaN(p) || math.IsInf(p, 0) {
+			t.Fatalf("Classify[%s] = %v after TF-IDF conversion, want a finite probability", class, p)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("ConvertTermsFreqToTFIDF called twice did not panic")
+		}
+	}()
+	tfidf.ConvertTermsFreqToTFIDF()
+}
+
+func TestSaveLoadRoundTripWithSameTokenizer(t *testing.T) {
+	tokenizer := NGramTokenizer(2, SpaceTokenizer)
+
+	c := NewClassifier(2, WithTokenizer(tokenizer))
+	c.Train("bom", "eu te adoro")
+	c.Train("bom", "eu te amo")
+	c.Train("ruim", "eu te odeio")
+	c.Train("ruim", "eu quero ver queimar")
+
+	sentence := "eu te adoro muito"
+	before := c.Classify(sentence)
+
+	var buf bytes.Buffer
+	if _, err := c.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+
+	loaded, err := LoadClassifier(&buf, WithTokenizer(tokenizer))
+	if err != nil {
+		t.Fatalf("LoadClassifier: %v", err)
+	}
+	after := loaded.Classify(sentence)
+
+	for class, want := range before {
+		got := after[class]
+		if math.Abs(got-want) > 1e-9 {
+			t.Fatalf("after round-trip, Classify[%s] = %v, want %v", class, got, want)
+		}
+	}
+}